@@ -0,0 +1,194 @@
+package app
+
+// Hot counters backed by Redis, flushed into the datastore baseline on a
+// cron-triggered task instead of writing to the datastore on every event
+import (
+	"appengine"
+	"appengine/datastore"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/Lerg/PenguinDaycareSimulatorServer/logging"
+)
+
+// Counters tracked per penguin
+var hotCounterNames = []string{"visit", "fish", "bellyrub"}
+
+var (
+	redisClientOnce sync.Once
+	redisClient     *redis.Client
+)
+
+// Lazily builds the Redis client from env vars on first use
+func getRedisClient() *redis.Client {
+	redisClientOnce.Do(func() {
+		db, err := strconv.Atoi(os.Getenv("REDIS_DB"))
+		if err != nil {
+			db = 0
+		}
+		redisClient = redis.NewClient(&redis.Options{
+			Addr:     os.Getenv("REDIS_ADDR"),
+			Password: os.Getenv("REDIS_PASSWORD"),
+			DB:       db,
+		})
+	})
+	return redisClient
+}
+
+func hotCounterKey(id, counter string) string {
+	return fmt.Sprintf("penguin:%s:%s", id, counter)
+}
+
+// Bumps a penguin's counter by one and fans out the counter's new Redis value
+// over the WebSocket hub. That value counts only increments not yet flushed
+// to the datastore; the datastore baseline is not added to it. INCR on a
+// missing key starts it at 0 before incrementing.
+func incrementHotCounter(c appengine.Context, correlationID, id, counter string) {
+	count, err := getRedisClient().Incr(context.Background(), hotCounterKey(id, counter)).Result()
+	if err != nil {
+		logging.Errorf(c, correlationID, "Can't increment hot counter for %s/%s: %v", id, counter, err)
+		return
+	}
+	publishDelta(id, counter, int(count))
+}
+
+// Reads every hot counter for a penguin in a single MGET
+func hotCounters(id string) (map[string]int, error) {
+	keys := make([]string, len(hotCounterNames))
+	for i, name := range hotCounterNames {
+		keys[i] = hotCounterKey(id, name)
+	}
+
+	vals, err := getRedisClient().MGet(context.Background(), keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	counters := make(map[string]int, len(hotCounterNames))
+	for i, name := range hotCounterNames {
+		counters[name] = parseHotCounter(vals[i])
+	}
+	return counters, nil
+}
+
+func parseHotCounter(v interface{}) int {
+	s, ok := v.(string)
+	if !ok {
+		return 0
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// Cron-triggered handler that drains every hot counter and rolls the delta
+// into the datastore baseline
+func flushCountersHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.Timeout(appengine.NewContext(r), time.Minute)
+	correlationID := logging.CorrelationID(r)
+	for _, p := range penguins {
+		if err := flushPenguinCounters(c, p.Id); err != nil {
+			logging.Errorf(c, correlationID, "Can't flush counters for %s: %v", p.Id, err)
+		}
+	}
+}
+
+// How long a penguin's flush lock is held, long enough to cover one flush
+// of all its counters, short enough that a crashed flush doesn't block the
+// next one for long
+const flushLockTTL = 30 * time.Second
+
+// Peeks each hot counter and only drains what was just confirmed written to
+// the datastore, so a failed or timed-out Put leaves the delta in Redis for
+// the next flush to pick up instead of losing it. Guarded by a per-penguin
+// lock so two overlapping invocations (a retried cron tick, a manual
+// trigger racing the cron) can't both apply and drain the same delta.
+func flushPenguinCounters(c appengine.Context, id string) error {
+	acquired, err := getRedisClient().SetNX(context.Background(), flushLockKey(id), "1", flushLockTTL).Result()
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return nil
+	}
+	defer getRedisClient().Del(context.Background(), flushLockKey(id))
+
+	for _, counter := range hotCounterNames {
+		delta, err := peekHotCounter(c, id, counter)
+		if err != nil {
+			return err
+		}
+		if delta == 0 {
+			continue
+		}
+		if err := applyDatastoreDelta(c, id, counter, delta); err != nil {
+			return err
+		}
+		if err := drainHotCounter(c, id, counter, delta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func flushLockKey(id string) string {
+	return fmt.Sprintf("penguin:%s:flush-lock", id)
+}
+
+// Reads a hot counter without resetting it
+func peekHotCounter(c appengine.Context, id, counter string) (int, error) {
+	val, err := getRedisClient().Get(context.Background(), hotCounterKey(id, counter)).Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(val)
+}
+
+// Removes exactly the delta that was just rolled into the datastore baseline,
+// leaving any increments that landed after the peek for the next flush
+func drainHotCounter(c appengine.Context, id, counter string, delta int) error {
+	return getRedisClient().DecrBy(context.Background(), hotCounterKey(id, counter), int64(delta)).Err()
+}
+
+// Applies a peeked Redis delta to the durable per-penguin entity inside a
+// transaction; the caller drains the delta from Redis only after this
+// succeeds. This writes a single flat ("Entity", id) key per penguin, not
+// sharded counters: events only touch Redis, and this key is written once
+// per counter per flush, so it doesn't become a write hot spot.
+func applyDatastoreDelta(c appengine.Context, id, counter string, delta int) error {
+	key := datastore.NewKey(c, "Entity", id, 0, nil)
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var p penguinEntity
+		getStart := time.Now()
+		err := datastore.Get(c, key, &p)
+		observeDatastoreOp("get", getStart)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		p.Id = id
+		switch counter {
+		case "visit":
+			p.VisitCount += delta
+		case "fish":
+			p.FishCount += delta
+		case "bellyrub":
+			p.BellyrubCount += delta
+		}
+		putStart := time.Now()
+		_, err = datastore.Put(c, key, &p)
+		observeDatastoreOp("put", putStart)
+		return err
+	}, nil)
+}
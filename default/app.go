@@ -11,6 +11,8 @@ import (
 	"os"
 	"sync"
 	"time"
+
+	"github.com/Lerg/PenguinDaycareSimulatorServer/logging"
 )
 
 // Each penguin has following fields
@@ -26,13 +28,13 @@ type penguin struct {
 // Array of penguins
 var penguins []penguin
 
-// Track time of last read from the DB for caching
+// Track time of the last datastore+Redis merge, exposed via penguin_cache_age_seconds
 var lastUpdateTime time.Time
 
 // Mutex for goroutine safe operations on penguins array
 var mutex sync.RWMutex
 
-// DB records
+// DB records, the durable baseline each counter is rolled up into
 type penguinEntity struct {
 	Id            string
 	VisitCount    int
@@ -44,12 +46,16 @@ type penguinEntity struct {
 func init() {
 	loadPenguinsJson()
 	lastUpdateTime = time.Now().Add(-20 * time.Minute)
-	http.HandleFunc("/", rootHandler)
-	http.HandleFunc("/penguins", penguinsHandler)
-	http.HandleFunc("/update", updateHandler)
-	http.HandleFunc("/stat/visit", visitHandler)
-	http.HandleFunc("/stat/fish", fishHandler)
-	http.HandleFunc("/stat/bellyrub", bellyrubHandler)
+	http.HandleFunc("/", logging.WithCorrelationID(rootHandler))
+	http.HandleFunc("/penguins", logging.WithCorrelationID(penguinsHandler))
+	http.HandleFunc("/update", logging.WithCorrelationID(updateHandler))
+	http.HandleFunc("/auth/device", logging.WithCorrelationID(authDeviceHandler))
+	http.HandleFunc("/stat/visit", logging.WithCorrelationID(withDeviceAuth("visit", visitHandler)))
+	http.HandleFunc("/stat/fish", logging.WithCorrelationID(withDeviceAuth("fish", fishHandler)))
+	http.HandleFunc("/stat/bellyrub", logging.WithCorrelationID(withDeviceAuth("bellyrub", bellyrubHandler)))
+	http.HandleFunc("/tasks/flush-counters", logging.WithCorrelationID(flushCountersHandler))
+	http.HandleFunc("/ws/penguins", logging.WithCorrelationID(wsPenguinsHandler))
+	go hub.run()
 }
 
 // Read out configuration file, which describes what penguins do we have
@@ -76,96 +82,93 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Hello! This is Penguin Daycare Simulator backend! Number of penguins loaded: %d", len(penguins))
 }
 
-// Send penguins array to the mobile app with statistics info
+// Send penguins array to the mobile app with statistics info. Always merges
+// in the latest Redis counters, so there's no stale-cache window to wait out.
 func penguinsHandler(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
-	updatePenguinsStatistics(c)
+	updatePenguinsStatistics(c, logging.CorrelationID(r))
 	// Lock penguins for reading
 	mutex.RLock()
 	defer mutex.RUnlock()
 	p, err := json.Marshal(penguins)
 	if err != nil {
-		c.Errorf("Can't create JSON response: %v", err)
+		logging.Errorf(c, logging.CorrelationID(r), "Can't create JSON response: %v", err)
 		return
 	}
 	fmt.Fprint(w, string(p))
 }
 
-// Cache management, don't read from the DB until certain amount of time has passed
-func updatePenguinsStatistics(c appengine.Context) {
-	if time.Since(lastUpdateTime) <= 10*time.Minute {
-		return
-	}
+// Refreshes the penguins slice with the datastore baseline plus whatever
+// hasn't been flushed from Redis yet
+func updatePenguinsStatistics(c appengine.Context, correlationID string) {
 	// Lock penguins for writing
 	mutex.Lock()
 	defer mutex.Unlock()
-	lastUpdateTime = time.Now()
+	start := time.Now()
+	lastUpdateTime = start
 	for i, p := range penguins {
-		penguin_db := dbGetPenguin(c, p.Id)
-		penguins[i].VisitCount = penguin_db.VisitCount
-		penguins[i].FishCount = penguin_db.FishCount
-		penguins[i].BellyrubCount = penguin_db.BellyrubCount
+		baseline := dbGetPenguin(c, p.Id)
+		hot, err := hotCounters(p.Id)
+		if err != nil {
+			logging.Errorf(c, correlationID, "Can't read hot counters for %s: %v", p.Id, err)
+			hot = map[string]int{}
+		}
+		penguins[i].VisitCount = baseline.VisitCount + hot["visit"]
+		penguins[i].FishCount = baseline.FishCount + hot["fish"]
+		penguins[i].BellyrubCount = baseline.BellyrubCount + hot["bellyrub"]
 	}
+	logging.Infof(c, correlationID, "Refreshed %d penguin stat rows in %s", len(penguins), time.Since(start))
 }
 
-// Force update handler
+// Force update handler, gated behind the admin bypass token
 func updateHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if !isAdminAuthorized(c, r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 	lastUpdateTime = time.Now().Add(-20 * time.Minute)
+	updatePenguinsStatistics(c, logging.CorrelationID(r))
 }
 
 // Handle visits event
-func visitHandler(w http.ResponseWriter, r *http.Request) {
+func visitHandler(w http.ResponseWriter, r *http.Request, deviceId string) {
 	c := appengine.NewContext(r)
 	penguin_id := r.FormValue("id")
-	if penguinExists(penguin_id) {
-		penguin_db := dbGetPenguin(c, penguin_id)
-		penguin_db.VisitCount += 1
-		k := datastore.NewKey(c, "Entity", penguin_id, 0, nil)
-		_, err := datastore.Put(c, k, &penguin_db)
-		if err != nil {
-			c.Errorf("Error writing into the datastore: %v", err)
-			return
-		}
+	if penguinExists(c, r, penguin_id) {
+		penguinEventsTotal.WithLabelValues(penguin_id, "visit").Inc()
+		incrementHotCounter(c, logging.CorrelationID(r), penguin_id, "visit")
 	}
 }
 
 // Handle fish event
-func fishHandler(w http.ResponseWriter, r *http.Request) {
+func fishHandler(w http.ResponseWriter, r *http.Request, deviceId string) {
 	c := appengine.NewContext(r)
 	penguin_id := r.FormValue("id")
-	if penguinExists(penguin_id) {
-		penguin_db := dbGetPenguin(c, penguin_id)
-		penguin_db.FishCount += 1
-		k := datastore.NewKey(c, "Entity", penguin_id, 0, nil)
-		_, err := datastore.Put(c, k, &penguin_db)
-		if err != nil {
-			c.Errorf("Error writing into the datastore: %v", err)
-			return
-		}
+	if penguinExists(c, r, penguin_id) {
+		penguinEventsTotal.WithLabelValues(penguin_id, "fish").Inc()
+		incrementHotCounter(c, logging.CorrelationID(r), penguin_id, "fish")
 	}
 }
 
 // Handle bellyrub event
-func bellyrubHandler(w http.ResponseWriter, r *http.Request) {
+func bellyrubHandler(w http.ResponseWriter, r *http.Request, deviceId string) {
 	c := appengine.NewContext(r)
 	penguin_id := r.FormValue("id")
-	if penguinExists(penguin_id) {
-		penguin_db := dbGetPenguin(c, penguin_id)
-		penguin_db.BellyrubCount += 1
-		k := datastore.NewKey(c, "Entity", penguin_id, 0, nil)
-		_, err := datastore.Put(c, k, &penguin_db)
-		if err != nil {
-			c.Errorf("Error writing into the datastore: %v", err)
-			return
-		}
+	if penguinExists(c, r, penguin_id) {
+		penguinEventsTotal.WithLabelValues(penguin_id, "bellyrub").Inc()
+		incrementHotCounter(c, logging.CorrelationID(r), penguin_id, "bellyrub")
 	}
 }
 
-// Reads a record from the DB
+// Reads the durable baseline for a penguin from the datastore
 func dbGetPenguin(c appengine.Context, id string) penguinEntity {
 	var p penguinEntity
 	k := datastore.NewKey(c, "Entity", id, 0, nil)
-	if err := datastore.Get(c, k, &p); err != nil {
+	start := time.Now()
+	err := datastore.Get(c, k, &p)
+	observeDatastoreOp("get", start)
+	if err != nil {
 		// If there is no record in the DB for the requested penguin, return an empty struct
 		// with correct Id for later writing into the DB
 		p.Id = id
@@ -173,8 +176,8 @@ func dbGetPenguin(c appengine.Context, id string) penguinEntity {
 	return p
 }
 
-// Checks for a valid penguin id
-func penguinExists(id string) bool {
+// Checks for a valid penguin id, warning with the client IP when it isn't
+func penguinExists(c appengine.Context, r *http.Request, id string) bool {
 	// Lock penguins for reading
 	mutex.RLock()
 	defer mutex.RUnlock()
@@ -185,5 +188,9 @@ func penguinExists(id string) bool {
 			break
 		}
 	}
+	if !result {
+		penguinInvalidIdTotal.Inc()
+		logging.Warningf(c, logging.CorrelationID(r), "Unknown penguin id %q submitted from %s", id, r.RemoteAddr)
+	}
 	return result
 }
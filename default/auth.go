@@ -0,0 +1,195 @@
+package app
+
+// HMAC-signed per-device tokens and memcache-backed per-event cooldown for the
+// /stat/* endpoints, plus an admin bypass token for /update
+import (
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"github.com/Lerg/PenguinDaycareSimulatorServer/logging"
+)
+
+// Per-device claims embedded in the signed token
+type deviceClaims struct {
+	DeviceId string `json:"device_id"`
+	jwt.RegisteredClaims
+}
+
+// Datastore-backed config, currently just the admin bypass token
+type adminConfig struct {
+	BypassToken string
+}
+
+// Minimum time between accepted requests of a given event type per device
+var cooldownIntervals = map[string]time.Duration{
+	"visit":    10 * time.Second,
+	"fish":     2 * time.Second,
+	"bellyrub": 1 * time.Second,
+}
+
+// Minimum time between device tokens minted for the same client. Without
+// this, a caller can dodge the per-device cooldown below by just hitting
+// /auth/device for a fresh deviceId before every stat event.
+const deviceMintCooldown = 10 * time.Second
+
+func signingKey() []byte {
+	return []byte(os.Getenv("AUTH_SIGNING_KEY"))
+}
+
+// Mints a short-lived per-device token
+func authDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	allowed, err := checkMemcacheCooldown(c, "auth-device:"+r.RemoteAddr, deviceMintCooldown)
+	if err != nil {
+		logging.Errorf(c, logging.CorrelationID(r), "Device mint cooldown check failed for %s: %v", r.RemoteAddr, err)
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+	if !allowed {
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+
+	deviceId, err := newDeviceId()
+	if err != nil {
+		http.Error(w, "Can't generate device id", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	claims := deviceClaims{
+		DeviceId: deviceId,
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(24 * time.Hour)),
+		},
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(signingKey())
+	if err != nil {
+		http.Error(w, "Can't sign token", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"token": signed})
+}
+
+func newDeviceId() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := cryptorand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// A stat handler that has already been authenticated for a given device
+type authedHandler func(w http.ResponseWriter, r *http.Request, deviceId string)
+
+// Wraps a /stat/* handler so it requires a valid device token and enforces
+// the per-event cooldown before the handler runs
+func withDeviceAuth(event string, next authedHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := appengine.NewContext(r)
+		deviceId, ok := verifyDeviceToken(r)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		allowed, err := checkCooldown(c, deviceId, event)
+		if err != nil {
+			// Fail closed: a memcache outage is exactly the kind of backend
+			// flakiness most likely to coincide with an abuse burst, so don't
+			// let a cooldown check error silently disable rate limiting.
+			logging.Errorf(c, logging.CorrelationID(r), "Rate limit check failed for %s/%s: %v", deviceId, event, err)
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		if !allowed {
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+
+		next(w, r, deviceId)
+	}
+}
+
+// Parses and validates the bearer token, returning the device id it carries
+func verifyDeviceToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", false
+	}
+	raw := strings.TrimPrefix(header, "Bearer ")
+
+	token, err := jwt.ParseWithClaims(raw, &deviceClaims{}, func(t *jwt.Token) (interface{}, error) {
+		return signingKey(), nil
+	})
+	if err != nil || !token.Valid {
+		return "", false
+	}
+	claims, ok := token.Claims.(*deviceClaims)
+	if !ok || claims.DeviceId == "" {
+		return "", false
+	}
+	return claims.DeviceId, true
+}
+
+// Enforces a fixed cooldown per device/event pair rather than a refillable
+// token bucket: one accepted request per interval
+func checkCooldown(c appengine.Context, deviceId, event string) (bool, error) {
+	interval, ok := cooldownIntervals[event]
+	if !ok {
+		return true, nil
+	}
+	return checkMemcacheCooldown(c, deviceId+":"+event, interval)
+}
+
+// Enforces a cooldown on a single memcache key, backed by memcache.Add which
+// only succeeds if the key isn't already set
+func checkMemcacheCooldown(c appengine.Context, key string, interval time.Duration) (bool, error) {
+	item := &memcache.Item{
+		Key:        key,
+		Value:      []byte("1"),
+		Expiration: interval,
+	}
+	switch err := memcache.Add(c, item); err {
+	case nil:
+		return true, nil
+	case memcache.ErrNotStored:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// Loads the admin bypass token from the datastore config entity
+func adminBypassToken(c appengine.Context) (string, error) {
+	var cfg adminConfig
+	k := datastore.NewKey(c, "Config", "admin", 0, nil)
+	if err := datastore.Get(c, k, &cfg); err != nil {
+		return "", err
+	}
+	return cfg.BypassToken, nil
+}
+
+// Checks the bearer token against the admin bypass token
+func isAdminAuthorized(c appengine.Context, r *http.Request) bool {
+	bypass, err := adminBypassToken(c)
+	if err != nil {
+		logging.Errorf(c, logging.CorrelationID(r), "Can't load admin bypass token: %v", err)
+		return false
+	}
+	header := r.Header.Get("Authorization")
+	return bypass != "" && header == "Bearer "+bypass
+}
@@ -0,0 +1,47 @@
+package app
+
+// Prometheus instrumentation, exposed on /metrics alongside the JSON routes
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	penguinEventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "penguin_events_total",
+		Help: "Number of visit/fish/bellyrub events recorded per penguin.",
+	}, []string{"penguin_id", "event"})
+
+	datastoreOpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "datastore_op_duration_seconds",
+		Help: "Latency of datastore Get/Put calls.",
+	}, []string{"op"})
+
+	penguinInvalidIdTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "penguin_invalid_id_total",
+		Help: "Number of requests submitted with an unknown penguin id.",
+	})
+
+	penguinCacheAgeSeconds = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "penguin_cache_age_seconds",
+		Help: "Age of the in-memory penguins cache.",
+	}, func() float64 {
+		return time.Since(lastUpdateTime).Seconds()
+	})
+)
+
+func init() {
+	prometheus.MustRegister(penguinEventsTotal)
+	prometheus.MustRegister(datastoreOpDuration)
+	prometheus.MustRegister(penguinInvalidIdTotal)
+	prometheus.MustRegister(penguinCacheAgeSeconds)
+	http.Handle("/metrics", promhttp.Handler())
+}
+
+// Times a datastore op and records it under datastore_op_duration_seconds
+func observeDatastoreOp(op string, start time.Time) {
+	datastoreOpDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
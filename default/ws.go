@@ -0,0 +1,195 @@
+package app
+
+// Real-time push of penguin stats over WebSockets, so the mobile app can
+// show live counter changes without polling /penguins
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A single counter change, broadcast to every connected client
+type penguinDelta struct {
+	Id      string `json:"id"`
+	Counter string `json:"counter"`
+	Count   int    `json:"count"`
+}
+
+// Default maximum number of simultaneous WebSocket clients, overridable via
+// the MAX_WS_CONNECTIONS env var
+const defaultMaxWsConnections = 100
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = (wsPongWait * 9) / 10
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// Reads MAX_WS_CONNECTIONS from the environment, falling back to
+// defaultMaxWsConnections when unset or invalid
+func maxWsConnections() int {
+	n, err := strconv.Atoi(os.Getenv("MAX_WS_CONNECTIONS"))
+	if err != nil || n <= 0 {
+		return defaultMaxWsConnections
+	}
+	return n
+}
+
+// A connected client and the mutex serializing writes to it. gorilla/websocket
+// only allows one concurrent writer per connection, and both the broadcast
+// goroutine and this client's own ping ticker write to it.
+type wsClient struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+}
+
+func (wc *wsClient) writeMessage(messageType int, data []byte) error {
+	// Lock out the ping ticker (or another broadcast) while we write
+	wc.writeMu.Lock()
+	defer wc.writeMu.Unlock()
+	wc.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return wc.conn.WriteMessage(messageType, data)
+}
+
+// Registry of active connections and the channel deltas are fanned out on
+type connHub struct {
+	mu      sync.RWMutex
+	clients map[*wsClient]bool
+	deltas  chan penguinDelta
+}
+
+var hub = &connHub{
+	clients: make(map[*wsClient]bool),
+	deltas:  make(chan penguinDelta, 100),
+}
+
+// Runs in its own goroutine, broadcasting deltas off the request goroutine
+// that produced them so datastore latency can't stall event emission
+func (h *connHub) run() {
+	for d := range h.deltas {
+		h.broadcast(d)
+	}
+}
+
+func (h *connHub) count() int {
+	// Lock clients for reading
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients)
+}
+
+func (h *connHub) add(wc *wsClient) {
+	// Lock clients for writing
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[wc] = true
+}
+
+func (h *connHub) remove(wc *wsClient) {
+	// Lock clients for writing
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, wc)
+}
+
+func (h *connHub) broadcast(d penguinDelta) {
+	msg, err := json.Marshal(d)
+	if err != nil {
+		return
+	}
+	// Lock clients for reading
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for wc := range h.clients {
+		if err := wc.writeMessage(websocket.TextMessage, msg); err != nil {
+			go h.remove(wc)
+		}
+	}
+}
+
+// Queues a delta for broadcast without blocking the caller; if the hub is
+// backed up the delta is dropped rather than stalling the caller
+func publishDelta(id, counter string, count int) {
+	select {
+	case hub.deltas <- penguinDelta{Id: id, Counter: counter, Count: count}:
+	default:
+	}
+}
+
+// Upgrades the connection, sends the initial snapshot, then keeps it alive
+// until the client disconnects
+func wsPenguinsHandler(w http.ResponseWriter, r *http.Request) {
+	if hub.count() >= maxWsConnections() {
+		http.Error(w, "Too many connections", http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	wc := &wsClient{conn: conn}
+	hub.add(wc)
+	go serveWsConn(wc)
+}
+
+// Sends the initial snapshot and pumps ping/pong keepalive until the
+// connection drops
+func serveWsConn(wc *wsClient) {
+	defer func() {
+		hub.remove(wc)
+		wc.conn.Close()
+	}()
+
+	wc.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	wc.conn.SetPongHandler(func(string) error {
+		wc.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		return nil
+	})
+
+	// Lock penguins for reading
+	mutex.RLock()
+	snapshot, err := json.Marshal(penguins)
+	mutex.RUnlock()
+	if err != nil {
+		return
+	}
+	if err := wc.writeMessage(websocket.TextMessage, snapshot); err != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := wc.conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := wc.writeMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Package logging wraps the appengine log levels with a per-request
+// correlation id, so related log lines across a single request can be
+// grepped together, and an optional JSON line format for external sinks.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"appengine"
+)
+
+type correlationIDKeyType struct{}
+
+var correlationIDKey correlationIDKeyType
+
+// Set LOG_FORMAT=json to emit one JSON object per log line instead of plain text
+var jsonFormat = os.Getenv("LOG_FORMAT") == "json"
+
+// WithCorrelationID wraps a handler so every log line it emits can be tied
+// back to the request that triggered it
+func WithCorrelationID(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := newCorrelationID()
+		if err != nil {
+			id = "unknown"
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), correlationIDKey, id)))
+	}
+}
+
+// CorrelationID returns the id WithCorrelationID attached to the request
+func CorrelationID(r *http.Request) string {
+	id, _ := r.Context().Value(correlationIDKey).(string)
+	return id
+}
+
+func newCorrelationID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+type logLine struct {
+	Level         string `json:"level"`
+	Message       string `json:"message"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+func Debugf(c appengine.Context, correlationID, format string, args ...interface{}) {
+	emit(c.Debugf, "debug", correlationID, format, args...)
+}
+
+func Infof(c appengine.Context, correlationID, format string, args ...interface{}) {
+	emit(c.Infof, "info", correlationID, format, args...)
+}
+
+func Warningf(c appengine.Context, correlationID, format string, args ...interface{}) {
+	emit(c.Warningf, "warning", correlationID, format, args...)
+}
+
+func Errorf(c appengine.Context, correlationID, format string, args ...interface{}) {
+	emit(c.Errorf, "error", correlationID, format, args...)
+}
+
+func emit(logf func(string, ...interface{}), level, correlationID, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+
+	if !jsonFormat {
+		if correlationID != "" {
+			logf("[%s] %s", correlationID, message)
+		} else {
+			logf("%s", message)
+		}
+		return
+	}
+
+	line, err := json.Marshal(logLine{Level: level, Message: message, CorrelationID: correlationID})
+	if err != nil {
+		logf("%s", message)
+		return
+	}
+	logf("%s", line)
+}